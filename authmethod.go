@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// The OIDC client authentication methods supported by --oidc.auth-method.
+const (
+	authMethodClientSecretBasic = "client_secret_basic"
+	authMethodClientSecretPost  = "client_secret_post"
+	authMethodPrivateKeyJWT     = "private_key_jwt"
+	authMethodTLSClientAuth     = "tls_client_auth"
+	authMethodWorkloadIdentity  = "workload_identity"
+
+	// clientAssertionType is the assertion type RFC 7523 requires for
+	// JWT-bearer client authentication, used by both private_key_jwt and
+	// workload_identity.
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+)
+
+// newAuthMethodTokenSource builds the oauth2.TokenSource that performs the
+// client_credentials grant against tokenURL, using the client authentication
+// method selected by o.authMethod.
+func newAuthMethodTokenSource(ctx context.Context, rt *roundTripperInstrumenter, tokenURL string, o oidcConfig, name string) (oauth2.TokenSource, error) {
+	switch o.authMethod {
+	case authMethodPrivateKeyJWT:
+		signer, err := newJWTSigner(o.jwtSigningKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure --oidc.auth-method=private_key_jwt: %w", err)
+		}
+
+		return &assertionTokenSource{
+			ctx:      ctx,
+			clientID: o.clientID,
+			audience: o.audience,
+			tokenURL: tokenURL,
+			assertion: func() (string, error) {
+				return mintClientAssertionJWT(signer, o.clientID, tokenURL)
+			},
+		}, nil
+
+	case authMethodWorkloadIdentity:
+		if o.workloadIdentityTokenFile == "" {
+			return nil, errors.New("--oidc.workload-identity-token-file is required for --oidc.auth-method=workload_identity")
+		}
+
+		return &assertionTokenSource{
+			ctx:      ctx,
+			clientID: o.clientID,
+			audience: o.audience,
+			tokenURL: tokenURL,
+			assertion: func() (string, error) {
+				return readWorkloadIdentityToken(o.workloadIdentityTokenFile)
+			},
+		}, nil
+
+	case authMethodTLSClientAuth:
+		cert, err := tls.LoadX509KeyPair(o.tlsClientCertFile, o.tlsClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure --oidc.auth-method=tls_client_auth: %w", err)
+		}
+
+		client := &http.Client{
+			Transport: rt.NewRoundTripper(name, &http.Transport{
+				TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+			}),
+		}
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
+
+		ccc := clientcredentials.Config{
+			ClientID: o.clientID,
+			TokenURL: tokenURL,
+			// No ClientSecret is set here: authentication is via the mTLS
+			// client certificate above. The zero-value AuthStyleUnknown
+			// would otherwise make the oauth2 library probe with a
+			// client_secret_basic attempt using an empty secret on every
+			// request, which strict IdPs reject outright.
+			AuthStyle: oauth2.AuthStyleInParams,
+		}
+		if o.audience != "" {
+			ccc.EndpointParams = url.Values{"audience": {o.audience}}
+		}
+
+		return ccc.TokenSource(ctx), nil
+
+	case authMethodClientSecretPost, authMethodClientSecretBasic:
+		ccc := clientcredentials.Config{
+			ClientID:     o.clientID,
+			ClientSecret: o.clientSecret,
+			TokenURL:     tokenURL,
+		}
+		if o.authMethod == authMethodClientSecretPost {
+			ccc.AuthStyle = oauth2.AuthStyleInParams
+		} else {
+			ccc.AuthStyle = oauth2.AuthStyleInHeader
+		}
+		if o.audience != "" {
+			ccc.EndpointParams = url.Values{"audience": {o.audience}}
+		}
+
+		return ccc.TokenSource(ctx), nil
+
+	default:
+		return nil, fmt.Errorf("unknown oidc auth method %q", o.authMethod)
+	}
+}
+
+// assertionTokenSource performs a client_credentials grant authenticated by
+// a JWT-bearer client assertion (RFC 7523), re-minting the assertion via
+// assertion() on every token acquisition so it never reuses an expired one.
+type assertionTokenSource struct {
+	ctx      context.Context
+	clientID string
+	audience string
+	tokenURL string
+
+	assertion func() (string, error)
+}
+
+func (s *assertionTokenSource) Token() (*oauth2.Token, error) {
+	assertion, err := s.assertion()
+	if err != nil {
+		return nil, fmt.Errorf("failed to produce client assertion: %w", err)
+	}
+
+	ccc := clientcredentials.Config{
+		ClientID: s.clientID,
+		TokenURL: s.tokenURL,
+		EndpointParams: url.Values{
+			"client_assertion_type": {clientAssertionType},
+			"client_assertion":      {assertion},
+		},
+		// No ClientSecret is set here: authentication is via the client
+		// assertion above. The zero-value AuthStyleUnknown would otherwise
+		// make the oauth2 library probe with a client_secret_basic attempt
+		// using an empty secret on every request, which strict IdPs reject
+		// outright.
+		AuthStyle: oauth2.AuthStyleInParams,
+	}
+	if s.audience != "" {
+		ccc.EndpointParams.Set("audience", s.audience)
+	}
+
+	return ccc.TokenSource(s.ctx).Token()
+}
+
+// mintClientAssertionJWT signs a short-lived client assertion JWT as
+// described in https://tools.ietf.org/html/rfc7523#section-2.2.
+func mintClientAssertionJWT(signer jose.Signer, clientID, tokenURL string) (string, error) {
+	now := time.Now()
+	claims := jwt.Claims{
+		Issuer:   clientID,
+		Subject:  clientID,
+		Audience: jwt.Audience{tokenURL},
+		Expiry:   jwt.NewNumericDate(now.Add(2 * time.Minute)),
+		IssuedAt: jwt.NewNumericDate(now),
+		ID:       newJTI(),
+	}
+
+	return jwt.Signed(signer).Claims(claims).CompactSerialize()
+}
+
+// newJTI generates a random client assertion ID.
+func newJTI() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// readWorkloadIdentityToken reads the current contents of a projected token
+// file, e.g. a Kubernetes service account token mounted at
+// /var/run/secrets/tokens/..., which is rotated on disk by the kubelet.
+func readWorkloadIdentityToken(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read workload identity token file: %w", err)
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+// newJWTSigner loads a PEM-encoded RSA, ECDSA or Ed25519 private key and
+// returns a signer for the corresponding JWS algorithm.
+func newJWTSigner(path string) (jose.Signer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key file: %w", err)
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	key, err := parsePrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	var alg jose.SignatureAlgorithm
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		alg = jose.RS256
+	case *ecdsa.PrivateKey:
+		alg = jose.ES256
+	case ed25519.PrivateKey:
+		alg = jose.EdDSA
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	return jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, nil)
+}
+
+func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	return nil, errors.New("unsupported private key encoding")
+}
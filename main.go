@@ -2,16 +2,17 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	stdlog "log"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -25,25 +26,34 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	flag "github.com/spf13/pflag"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/clientcredentials"
 )
 
 const (
-	retryInterval = 5 * time.Second
-	prefixHeader  = "X-Forwarded-Prefix"
+	prefixHeader = "X-Forwarded-Prefix"
+
+	// fileWriteRetryInterval is how often --file mode retries writing the
+	// token file after a transient I/O error (e.g. ENOSPC, a busy temp
+	// dir), independently of how long until the token itself needs
+	// refreshing.
+	fileWriteRetryInterval = 5 * time.Second
 )
 
 type config struct {
-	file      string
-	logLevel  level.Option
-	logFormat string
-	margin    time.Duration
-	name      string
-	tempFile  string
-	url       *url.URL
-
-	oidc   oidcConfig
-	server serverConfig
+	configFile string
+	file       string
+	logLevel   level.Option
+	logFormat  string
+	margin     time.Duration
+	name       string
+	tempFile   string
+	url        *url.URL
+
+	forwardAuth forwardAuthConfig
+	oidc        oidcConfig
+	retry       retryConfig
+	serve       serveConfig
+	server      serverConfig
+	tls         tlsConfig
 }
 
 type serverConfig struct {
@@ -56,6 +66,12 @@ type oidcConfig struct {
 	clientID     string
 	clientSecret string
 	issuerURL    string
+
+	authMethod                string
+	jwtSigningKeyFile         string
+	workloadIdentityTokenFile string
+	tlsClientCertFile         string
+	tlsClientKeyFile          string
 }
 
 func parseFlags() (*config, error) {
@@ -69,10 +85,29 @@ func parseFlags() (*config, error) {
 	flag.StringVar(&cfg.oidc.clientSecret, "oidc.client-secret", "", "The OIDC client secret, see https://tools.ietf.org/html/rfc6749#section-2.3.")
 	flag.StringVar(&cfg.oidc.clientID, "oidc.client-id", "", "The OIDC client ID, see https://tools.ietf.org/html/rfc6749#section-2.3.")
 	flag.StringVar(&cfg.oidc.audience, "oidc.audience", "", "The audience for whom the access token is intended, see https://openid.net/specs/openid-connect-core-1_0.html#IDToken.")
+	flag.StringVar(&cfg.oidc.authMethod, "oidc.auth-method", authMethodClientSecretBasic, "The client authentication method to use against the token endpoint. Options: 'client_secret_basic', 'client_secret_post', 'private_key_jwt', 'tls_client_auth', 'workload_identity'.")
+	flag.StringVar(&cfg.oidc.jwtSigningKeyFile, "oidc.jwt-signing-key-file", "", "Path to a PEM-encoded RSA/ECDSA/Ed25519 private key used to sign the client assertion JWT for --oidc.auth-method=private_key_jwt.")
+	flag.StringVar(&cfg.oidc.workloadIdentityTokenFile, "oidc.workload-identity-token-file", "", "Path to a projected token file (e.g. a Kubernetes service account token) re-read and sent as the client assertion for --oidc.auth-method=workload_identity.")
+	flag.StringVar(&cfg.oidc.tlsClientCertFile, "oidc.tls-client-cert-file", "", "Path to a TLS client certificate presented to the token endpoint for --oidc.auth-method=tls_client_auth.")
+	flag.StringVar(&cfg.oidc.tlsClientKeyFile, "oidc.tls-client-key-file", "", "Path to the TLS private key matching --oidc.tls-client-cert-file.")
 	flag.StringVar(&cfg.file, "file", "", "The path to the file in which to write the retrieved token.")
 	flag.StringVar(&cfg.tempFile, "temp-file", "", "The path to a temporary file to use for atomically update the token file. If left empty, \".tmp\" will be suffixed to the token file.")
 	rawURL := flag.String("url", "", "The target URL to which to proxy requests. All requests will have the acces token in the Authorization HTTP header.")
+	flag.StringVar(&cfg.configFile, "config.file", "", "Path to a YAML/JSON file configuring multiple named upstreams, each with its own match rule and OIDC client. Takes precedence over --url/--oidc.* for the proxy server.")
 	flag.DurationVar(&cfg.margin, "margin", 5*time.Minute, "The margin of time before a token expires to try to refresh it.")
+	flag.IntVar(&cfg.retry.maxAttempts, "retry.max-attempts", 10, "The maximum number of consecutive attempts to acquire a token before giving up. 0 means unlimited.")
+	flag.DurationVar(&cfg.retry.initialBackoff, "retry.initial-backoff", 1*time.Second, "The initial backoff duration between token acquisition attempts.")
+	flag.DurationVar(&cfg.retry.maxBackoff, "retry.max-backoff", 30*time.Second, "The maximum backoff duration between token acquisition attempts.")
+	flag.BoolVar(&cfg.retry.jitter, "retry.jitter", true, "Whether to apply full jitter to the backoff between token acquisition attempts.")
+	flag.StringVar(&cfg.forwardAuth.listen, "forward-auth.listen", "", "The address on which to serve a GET /auth endpoint returning the current access token, for use as an nginx auth_request or Traefik forwardAuth target. Disabled if empty.")
+	flag.StringVar(&cfg.forwardAuth.headerPrefix, "forward-auth.header-prefix", "Bearer ", "The prefix to add to the access token in the Authorization response header of the forward-auth endpoint.")
+	copyClaims := flag.String("forward-auth.copy-claims", "", "A comma-separated list of access token claims to copy as X-Auth-Request-<Claim> response headers on the forward-auth endpoint.")
+	flag.StringVar(&cfg.tls.certFile, "web.tls.cert-file", "", "Path to a TLS certificate file for the internal, proxy, forward-auth and token-serving servers. A comma-separated list selects between certificates by SNI. Disabled if empty.")
+	flag.StringVar(&cfg.tls.keyFile, "web.tls.key-file", "", "Path to the TLS private key matching --web.tls.cert-file. A comma-separated list must match --web.tls.cert-file one-to-one.")
+	flag.StringVar(&cfg.tls.clientCAFile, "web.tls.client-ca-file", "", "Path to a PEM file of CA certificates to verify client certificates against, enabling mTLS.")
+	flag.DurationVar(&cfg.tls.reloadInterval, "web.tls.reload-interval", 30*time.Second, "How often to check --web.tls.cert-file/--web.tls.key-file for changes and reload them.")
+	flag.StringVar(&cfg.serve.listen, "serve.listen", "", "The address on which to serve a GET /token endpoint returning the current access token as JSON, for sidecar consumers that can't share a volume with --file. Prefix with \"unix:\" for a Unix socket. Disabled if empty.")
+	flag.StringVar(&cfg.serve.authToken, "serve.auth-token", "", "The bearer secret required to read the token-serving endpoint. Ignored, in favor of Unix socket peer credentials, when --serve.listen=unix:/path on Linux.")
 
 	flag.Parse()
 
@@ -97,8 +132,22 @@ func parseFlags() (*config, error) {
 		cfg.url = u
 	}
 
-	if cfg.file == "" && cfg.url == nil {
-		return nil, errors.New("one of --file or --url is required")
+	if *copyClaims != "" {
+		cfg.forwardAuth.copyClaims = strings.Split(*copyClaims, ",")
+	}
+
+	switch cfg.oidc.authMethod {
+	case authMethodClientSecretBasic, authMethodClientSecretPost, authMethodPrivateKeyJWT, authMethodTLSClientAuth, authMethodWorkloadIdentity:
+	default:
+		return nil, fmt.Errorf("unexpected --oidc.auth-method: %s", cfg.oidc.authMethod)
+	}
+
+	if cfg.file == "" && cfg.url == nil && cfg.configFile == "" && cfg.serve.listen == "" {
+		return nil, errors.New("one of --file, --url, --config.file or --serve.listen is required")
+	}
+
+	if cfg.serve.listen != "" && !(isUnixSocket(cfg.serve.listen) && peerCredSupported) && cfg.serve.authToken == "" {
+		return nil, errors.New("--serve.auth-token is required unless --serve.listen is a Unix socket on Linux")
 	}
 
 	if cfg.tempFile == "" {
@@ -149,8 +198,36 @@ func main() {
 			close(sig)
 		})
 	}
+	healthchecks := healthcheck.NewMetricsHandler(healthcheck.NewHandler(), reg)
+
+	var tlsCfg *tls.Config
+	if cfg.tls.enabled() {
+		store, err := newCertStore(strings.Split(cfg.tls.certFile, ","), strings.Split(cfg.tls.keyFile, ","))
+		if err != nil {
+			stdlog.Fatalf("failed to load TLS certificates: %v", err)
+		}
+		healthchecks.AddReadinessCheck("tls-certificate-reload", store.readinessCheck)
+
+		tlsCfg = &tls.Config{GetCertificate: store.GetCertificate}
+		if cfg.tls.clientCAFile != "" {
+			pool, err := loadCertPool(cfg.tls.clientCAFile)
+			if err != nil {
+				stdlog.Fatalf("failed to load --web.tls.client-ca-file: %v", err)
+			}
+			tlsCfg.ClientCAs = pool
+			tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+
+		certMetrics := newCertReloadMetrics(reg)
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return store.watch(ctx, cfg.tls.reloadInterval, certMetrics, logger)
+		}, func(_ error) {
+			cancel()
+		})
+	}
+
 	{
-		healthchecks := healthcheck.NewMetricsHandler(healthcheck.NewHandler(), reg)
 		h := internalserver.NewHandler(
 			internalserver.WithName("Internal - token-refresher API"),
 			internalserver.WithHealthchecks(healthchecks),
@@ -158,63 +235,115 @@ func main() {
 			internalserver.WithPProf(),
 		)
 
-		s := http.Server{
-			Addr:    cfg.server.listenInternal,
-			Handler: h,
+		s := &http.Server{
+			Addr:      cfg.server.listenInternal,
+			Handler:   h,
+			TLSConfig: cloneTLSConfig(tlsCfg),
 		}
 
 		g.Add(func() error {
 			level.Info(logger).Log("msg", "starting internal HTTP server", "address", s.Addr)
-			return s.ListenAndServe()
+			return serve(s)
 		}, func(err error) {
 			_ = s.Shutdown(context.Background())
 		})
 	}
-	{
-		provider, err := oidc.NewProvider(context.Background(), cfg.oidc.issuerURL)
+	rt := newRoundTripperInstrumenter(reg)
+	retryMetrics := newRetryMetrics(reg)
+	oauthCtx := context.Background()
+
+	if cfg.file != "" {
+		ctx, cancel := context.WithCancel(oauthCtx)
+		ts, err := newTokenSource(ctx, rt, cfg.oidc, cfg.retry, retryMetrics, "file")
 		if err != nil {
-			stdlog.Fatalf("OIDC provider initialization failed: %v", err)
+			stdlog.Fatalf("failed to configure token source: %v", err)
 		}
-		ctx := context.WithValue(context.Background(), oauth2.HTTPClient,
-			&http.Client{
-				Transport: newRoundTripperInstrumenter(reg).NewRoundTripper("oauth", http.DefaultTransport),
-			},
-		)
-		ccc := clientcredentials.Config{
-			ClientID:     cfg.oidc.clientID,
-			ClientSecret: cfg.oidc.clientSecret,
-			TokenURL:     provider.Endpoint().TokenURL,
+
+		g.Add(func() error {
+			return refreshTokenLoop(ctx, logger, ts, cfg.margin, func(t *oauth2.Token) error {
+				// A write/rename failure here is a transient local I/O
+				// problem (e.g. momentary ENOSPC or a busy temp dir), not a
+				// token-acquisition failure, so it must not propagate into
+				// refreshTokenLoop and tear down the process: retry the
+				// write on fileWriteRetryInterval until it succeeds or the
+				// process is shutting down.
+				for {
+					err := writeTokenFile(cfg.tempFile, cfg.file, t.AccessToken)
+					if err == nil {
+						return nil
+					}
+
+					level.Error(logger).Log("msg", "failed to write token file, will retry", "err", err)
+
+					select {
+					case <-time.After(fileWriteRetryInterval):
+					case <-ctx.Done():
+						return nil
+					}
+				}
+			})
+		}, func(_ error) {
+			cancel()
+		})
+	}
+
+	if cfg.url != nil || cfg.configFile != "" {
+		upstreams, err := resolveUpstreams(cfg)
+		if err != nil {
+			stdlog.Fatalf("failed to load upstreams: %v", err)
 		}
-		if cfg.oidc.audience != "" {
-			ccc.EndpointParams = url.Values{
-				"audience": []string{cfg.oidc.audience},
+
+		ctx, cancel := context.WithCancel(oauthCtx)
+		routes := make([]route, 0, len(upstreams))
+		for _, u := range upstreams {
+			target, err := url.Parse(u.URL)
+			if err != nil {
+				stdlog.Fatalf("upstream %q: invalid url: %v", u.Name, err)
 			}
-		}
 
-		if cfg.file != "" {
-			ctx, cancel := context.WithCancel(ctx)
+			ts, err := newTokenSource(ctx, rt, u.OIDC.toConfig(), cfg.retry, retryMetrics, u.Name)
+			if err != nil {
+				stdlog.Fatalf("upstream %q: failed to configure token source: %v", u.Name, err)
+			}
+
+			// The proxy never retries a token fetch on the request path: ts
+			// already retries with backoff in the background below, and the
+			// request path only ever reads the last-known-good token out of
+			// store, so a slow or down IdP can't make proxied requests hang.
+			store := newTokenStore()
+			down := &atomic.Bool{}
+			name := u.Name
 			g.Add(func() error {
+				// A single upstream's credentials being rotated/invalid, or
+				// its IdP exhausting --retry.max-attempts on a transient
+				// blip, must not cancel the other upstreams' healthy token
+				// loops or the proxy server: mark this upstream down for
+				// multiUpstreamHandler instead of returning the error into
+				// the run.Group. Unlike the single-upstream modes below,
+				// which still propagate the error and let the orchestrator
+				// restart the process, this upstream keeps retrying on
+				// cfg.retry.maxBackoff so it self-heals once the outage
+				// (transient or, eventually, a corrected credential) clears,
+				// without needing an operator restart.
 				for {
-					d := retryInterval
-					t, err := ccc.Token(ctx)
-					switch {
-					case err != nil:
-						level.Error(logger).Log("msg", "failed to get token", "err", err)
-					case !t.Valid():
-						level.Error(logger).Log("msg", "token is invalid", "exp", t.Expiry.String())
-					default:
-						if err := ioutil.WriteFile(cfg.tempFile, []byte(t.AccessToken), 0644); err != nil {
-							level.Error(logger).Log("msg", "failed to write token to temporary file", "err", err)
-							break
-						}
-						if err := os.Rename(cfg.tempFile, cfg.file); err != nil {
-							level.Error(logger).Log("msg", "failed to write token to file", "err", err)
-							break
-						}
-						d = t.Expiry.Sub(time.Now()) - cfg.margin
+					err := refreshTokenLoop(ctx, logger, ts, cfg.margin, func(t *oauth2.Token) error {
+						store.Set(t)
+						down.Store(false)
+						return nil
+					})
+					if ctx.Err() != nil {
+						return nil
 					}
+
+					down.Store(true)
+					if isFatalTokenError(err) {
+						level.Error(logger).Log("msg", "upstream token refresh failed with a non-retryable credential error; its routes will serve 502 until it recovers", "upstream", name, "err", err)
+					} else {
+						level.Error(logger).Log("msg", "upstream token refresh exhausted --retry.max-attempts; its routes will serve 502 until it recovers", "upstream", name, "err", err)
+					}
+
 					select {
-					case <-time.NewTimer(d).C:
+					case <-time.After(cfg.retry.maxBackoff):
 					case <-ctx.Done():
 						return nil
 					}
@@ -222,39 +351,99 @@ func main() {
 			}, func(_ error) {
 				cancel()
 			})
+
+			routes = append(routes, route{
+				name:    u.Name,
+				matches: newMatcher(u.Match),
+				proxy:   newReverseProxy(target, &oauth2.Transport{Source: newBackgroundTokenSource(store)}),
+				down:    down,
+			})
 		}
 
-		if cfg.url != nil {
-			ctx, cancel := context.WithCancel(ctx)
-			// Create Reverse Proxy.
-			p := httputil.ReverseProxy{
-				Director: func(request *http.Request) {
-					request.URL.Scheme = cfg.url.Scheme
-					// Set the Host at both request and request.URL objects.
-					request.Host = cfg.url.Host
-					request.URL.Host = cfg.url.Host
-					// Derive path from the paths of configured URL and request URL.
-					request.URL.Path, request.URL.RawPath = joinURLPath(cfg.url, request.URL)
-					// Add prefix header with value "/", since from a client's perspective
-					// we are forwarding /<anything> to /<cfg.url.Path>/<anything>.
-					request.Header.Add(prefixHeader, "/")
-				},
-			}
-			p.Transport = &oauth2.Transport{
-				Source: ccc.TokenSource(ctx),
-			}
-			s := http.Server{
-				Addr:    cfg.server.listen,
-				Handler: signalhttp.NewHandlerInstrumenter(reg, nil).NewHandler(nil, &p),
-			}
-			g.Add(func() error {
-				level.Info(logger).Log("msg", "starting proxy server", "address", s.Addr)
-				return s.ListenAndServe()
-			}, func(err error) {
-				_ = s.Shutdown(context.Background())
-				cancel()
+		s := &http.Server{
+			Addr:      cfg.server.listen,
+			Handler:   signalhttp.NewHandlerInstrumenter(reg, nil).NewHandler(nil, &multiUpstreamHandler{routes: routes}),
+			TLSConfig: cloneTLSConfig(tlsCfg),
+		}
+		g.Add(func() error {
+			level.Info(logger).Log("msg", "starting proxy server", "address", s.Addr)
+			return serve(s)
+		}, func(err error) {
+			_ = s.Shutdown(context.Background())
+			cancel()
+		})
+	}
+
+	if cfg.forwardAuth.listen != "" {
+		ctx, cancel := context.WithCancel(oauthCtx)
+		ts, err := newTokenSource(ctx, rt, cfg.oidc, cfg.retry, retryMetrics, "forward-auth")
+		if err != nil {
+			stdlog.Fatalf("failed to configure token source: %v", err)
+		}
+
+		// As above: /auth reads the last-known-good token from store rather
+		// than calling the retrying ts directly, so it fails fast instead of
+		// blocking the auth_request/forwardAuth caller for the IdP retries.
+		store := newTokenStore()
+		g.Add(func() error {
+			return refreshTokenLoop(ctx, logger, ts, cfg.margin, func(t *oauth2.Token) error {
+				store.Set(t)
+				return nil
+			})
+		}, func(_ error) {
+			cancel()
+		})
+
+		s := &http.Server{
+			Addr:      cfg.forwardAuth.listen,
+			Handler:   signalhttp.NewHandlerInstrumenter(reg, nil).NewHandler(nil, newForwardAuthHandler(newBackgroundTokenSource(store), cfg.forwardAuth, logger)),
+			TLSConfig: cloneTLSConfig(tlsCfg),
+		}
+		g.Add(func() error {
+			level.Info(logger).Log("msg", "starting forward-auth server", "address", s.Addr)
+			return serve(s)
+		}, func(err error) {
+			_ = s.Shutdown(context.Background())
+			cancel()
+		})
+	}
+
+	if cfg.serve.listen != "" {
+		ctx, cancel := context.WithCancel(oauthCtx)
+		ts, err := newTokenSource(ctx, rt, cfg.oidc, cfg.retry, retryMetrics, "serve")
+		if err != nil {
+			stdlog.Fatalf("failed to configure token source: %v", err)
+		}
+
+		store := newTokenStore()
+		g.Add(func() error {
+			return refreshTokenLoop(ctx, logger, ts, cfg.margin, func(t *oauth2.Token) error {
+				store.Set(t)
+				return nil
 			})
+		}, func(_ error) {
+			cancel()
+		})
+
+		listener, err := newServeListener(cfg.serve.listen, logger)
+		if err != nil {
+			stdlog.Fatalf("failed to listen on --serve.listen: %v", err)
+		}
+
+		s := &http.Server{
+			Handler:   signalhttp.NewHandlerInstrumenter(reg, nil).NewHandler(nil, newTokenHandler(store, cfg.serve)),
+			TLSConfig: cloneTLSConfig(tlsCfg),
 		}
+		g.Add(func() error {
+			level.Info(logger).Log("msg", "starting token-serving HTTP server", "address", cfg.serve.listen)
+			if s.TLSConfig != nil {
+				return s.ServeTLS(listener, "", "")
+			}
+			return s.Serve(listener)
+		}, func(err error) {
+			_ = s.Shutdown(context.Background())
+			cancel()
+		})
 	}
 
 	if err := g.Run(); err != nil {
@@ -262,6 +451,74 @@ func main() {
 	}
 }
 
+// newTokenSource builds a retrying oauth2.TokenSource for a client_credentials
+// grant against the given OIDC issuer. ctx is cancelled to stop any in-flight
+// retries. All HTTP traffic the token source generates — OIDC discovery and
+// the token endpoint itself — is instrumented under the "client" label name,
+// so client_api_requests_total can be broken down per upstream.
+func newTokenSource(ctx context.Context, rt *roundTripperInstrumenter, o oidcConfig, retry retryConfig, metrics *retryMetrics, name string) (oauth2.TokenSource, error) {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{
+		Transport: rt.NewRoundTripper(name, http.DefaultTransport),
+	})
+
+	provider, err := oidc.NewProvider(ctx, o.issuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("OIDC provider initialization failed: %w", err)
+	}
+
+	source, err := newAuthMethodTokenSource(ctx, rt, provider.Endpoint().TokenURL, o, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRetryTokenSource(ctx, source, retry, metrics, name), nil
+}
+
+// writeTokenFile atomically writes accessToken to file by writing it to
+// tempFile first and renaming it into place.
+func writeTokenFile(tempFile, file, accessToken string) error {
+	if err := ioutil.WriteFile(tempFile, []byte(accessToken), 0644); err != nil {
+		return fmt.Errorf("failed to write token to temporary file: %w", err)
+	}
+	if err := os.Rename(tempFile, file); err != nil {
+		return fmt.Errorf("failed to rename temporary file to token file: %w", err)
+	}
+
+	return nil
+}
+
+// refreshTokenLoop repeatedly fetches a token from ts and hands it to
+// onToken, then sleeps until margin before the token's expiry and fetches
+// again, until ctx is cancelled (returning nil) or a token cannot be
+// acquired or is invalid (returning that error). ts already retries transient IdP failures
+// with backoff (see newRetryTokenSource), so this is the one place that
+// backoff plays out; onToken is handed each token to cache, so callers on
+// the request path never block on the IdP themselves.
+func refreshTokenLoop(ctx context.Context, logger log.Logger, ts oauth2.TokenSource, margin time.Duration, onToken func(*oauth2.Token) error) error {
+	for {
+		t, err := ts.Token()
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to get token", "err", err)
+			return err
+		}
+		if !t.Valid() {
+			err := fmt.Errorf("token is invalid, exp %s", t.Expiry)
+			level.Error(logger).Log("msg", "token is invalid", "exp", t.Expiry.String())
+			return err
+		}
+		if err := onToken(t); err != nil {
+			return err
+		}
+
+		d := t.Expiry.Sub(time.Now()) - margin
+		select {
+		case <-time.NewTimer(d).C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
 func singleJoiningSlash(a, b string) string {
 	aslash := strings.HasSuffix(a, "/")
 	bslash := strings.HasPrefix(b, "/")
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/oauth2"
+)
+
+// retryConfig controls the full-jitter exponential backoff policy used when
+// acquiring tokens from the IdP, see
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/.
+type retryConfig struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	jitter         bool
+}
+
+// backoff returns the delay to wait after the given attempt (0-indexed) has
+// failed, before the next one.
+func (c retryConfig) backoff(attempt int) time.Duration {
+	max := float64(c.maxBackoff)
+	d := math.Min(max, float64(c.initialBackoff)*math.Pow(2, float64(attempt)))
+
+	if !c.jitter {
+		return time.Duration(d)
+	}
+
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// retryMetrics are the Prometheus metrics exposed for the token retry policy.
+type retryMetrics struct {
+	retriesTotal       *prometheus.CounterVec
+	lastErrorTimestamp *prometheus.GaugeVec
+}
+
+func newRetryMetrics(r prometheus.Registerer) *retryMetrics {
+	m := &retryMetrics{
+		retriesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "token_retry_attempts_total",
+				Help: "A counter of token acquisition retries, by client.",
+			},
+			[]string{"client"},
+		),
+		lastErrorTimestamp: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "token_retry_last_error_timestamp_seconds",
+				Help: "The unix timestamp of the last token acquisition error, by client.",
+			},
+			[]string{"client"},
+		),
+	}
+
+	if r != nil {
+		r.MustRegister(m.retriesTotal, m.lastErrorTimestamp)
+	}
+
+	return m
+}
+
+// isFatalTokenError reports whether err is a token endpoint error that will
+// never succeed on retry, e.g. a 400/401 response indicating invalid_client.
+func isFatalTokenError(err error) bool {
+	var rerr *oauth2.RetrieveError
+	if !errors.As(err, &rerr) {
+		return false
+	}
+
+	return rerr.Response != nil &&
+		(rerr.Response.StatusCode == http.StatusBadRequest || rerr.Response.StatusCode == http.StatusUnauthorized)
+}
+
+// retryTokenSource wraps an oauth2.TokenSource, retrying transient failures
+// with full-jitter exponential backoff up to cfg.maxAttempts times (0 means
+// unlimited). Errors that isFatalTokenError identifies as non-retryable are
+// returned immediately.
+type retryTokenSource struct {
+	ctx     context.Context
+	source  oauth2.TokenSource
+	cfg     retryConfig
+	metrics *retryMetrics
+	client  string
+}
+
+func newRetryTokenSource(ctx context.Context, source oauth2.TokenSource, cfg retryConfig, metrics *retryMetrics, client string) oauth2.TokenSource {
+	return &retryTokenSource{ctx: ctx, source: source, cfg: cfg, metrics: metrics, client: client}
+}
+
+func (s *retryTokenSource) Token() (*oauth2.Token, error) {
+	var lastErr error
+
+	for attempt := 0; s.cfg.maxAttempts == 0 || attempt < s.cfg.maxAttempts; attempt++ {
+		t, err := s.source.Token()
+		if err == nil {
+			return t, nil
+		}
+
+		lastErr = err
+		s.metrics.lastErrorTimestamp.WithLabelValues(s.client).Set(float64(time.Now().Unix()))
+
+		if isFatalTokenError(err) {
+			return nil, fmt.Errorf("non-retryable token error: %w", err)
+		}
+
+		if s.cfg.maxAttempts != 0 && attempt+1 == s.cfg.maxAttempts {
+			break
+		}
+
+		s.metrics.retriesTotal.WithLabelValues(s.client).Inc()
+
+		select {
+		case <-time.After(s.cfg.backoff(attempt)):
+		case <-s.ctx.Done():
+			return nil, s.ctx.Err()
+		}
+	}
+
+	return nil, fmt.Errorf("giving up after retries: %w", lastErr)
+}
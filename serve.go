@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/oauth2"
+)
+
+// serveConfig configures the token-serving HTTP endpoint used by co-located
+// sidecar consumers that can't share a volume with --file.
+type serveConfig struct {
+	listen    string
+	authToken string
+}
+
+// longPollTimeout bounds how long a GET /token?wait=true request blocks for
+// a rotation before returning the current token.
+const longPollTimeout = 60 * time.Second
+
+// tokenStore holds the most recently acquired token along with a monotonic
+// index that increments on every rotation, so long-polling clients can wait
+// for the next one instead of polling.
+type tokenStore struct {
+	mu      sync.Mutex
+	token   *oauth2.Token
+	index   uint64
+	updated chan struct{}
+}
+
+func newTokenStore() *tokenStore {
+	return &tokenStore{updated: make(chan struct{})}
+}
+
+// Set stores t as the current token and wakes any waiters.
+func (s *tokenStore) Set(t *oauth2.Token) {
+	s.mu.Lock()
+	s.token = t
+	s.index++
+	close(s.updated)
+	s.updated = make(chan struct{})
+	s.mu.Unlock()
+}
+
+// Get returns the current token and its index.
+func (s *tokenStore) Get() (*oauth2.Token, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.token, s.index
+}
+
+// Wait blocks until the stored token has rotated past sinceIndex or ctx is
+// done, then returns the current token and index either way.
+func (s *tokenStore) Wait(ctx context.Context, sinceIndex uint64) (*oauth2.Token, uint64) {
+	s.mu.Lock()
+	token, index, ch := s.token, s.index, s.updated
+	s.mu.Unlock()
+
+	if index > sinceIndex {
+		return token, index
+	}
+
+	select {
+	case <-ch:
+	case <-ctx.Done():
+	}
+
+	return s.Get()
+}
+
+// backgroundTokenSource is an oauth2.TokenSource that serves whatever token
+// is currently in store instead of fetching one itself. It never blocks on
+// the IdP: the token is kept warm by a refreshTokenLoop actor running in the
+// background, so a request-path consumer (the proxy, the forward-auth
+// endpoint) fails fast instead of stalling for a retry policy's backoff.
+type backgroundTokenSource struct {
+	store *tokenStore
+}
+
+func newBackgroundTokenSource(store *tokenStore) oauth2.TokenSource {
+	return &backgroundTokenSource{store: store}
+}
+
+func (s *backgroundTokenSource) Token() (*oauth2.Token, error) {
+	t, _ := s.store.Get()
+	if t == nil {
+		return nil, errors.New("token unavailable: initial token acquisition is still in progress")
+	}
+	if !t.Valid() {
+		return nil, errors.New("token unavailable: last acquired token has expired")
+	}
+
+	return t, nil
+}
+
+// tokenResponse is the JSON body served at GET /token.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresAt   string `json:"expires_at"`
+}
+
+// newTokenHandler serves the current token from store at GET /token,
+// gated by cfg's bearer secret or Unix-socket peer credentials. It supports
+// an ETag/If-None-Match fast path and long-polling via ?wait=true&index=N,
+// which blocks until the token has rotated past N.
+func newTokenHandler(store *tokenStore, cfg serveConfig) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, cfg) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		t, index := store.Get()
+
+		if r.URL.Query().Get("wait") == "true" {
+			since, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+
+			ctx, cancel := context.WithTimeout(r.Context(), longPollTimeout)
+			defer cancel()
+
+			t, index = store.Wait(ctx, since)
+		}
+
+		if t == nil {
+			http.Error(w, "token unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		etag := strconv.Quote(strconv.FormatUint(index, 10))
+		w.Header().Set("ETag", etag)
+
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(tokenResponse{
+			AccessToken: t.AccessToken,
+			ExpiresAt:   t.Expiry.UTC().Format(time.RFC3339),
+		})
+	})
+
+	return mux
+}
+
+// authorized reports whether r may read the current token: Unix-socket
+// peers are vetted by peerCredListener at accept time and trusted without a
+// bearer secret, but only on platforms where peerCredSupported — elsewhere
+// peerCredAllowed can't verify anything, so a Unix-socket caller falls back
+// to the same bearer-secret check as everyone else.
+func authorized(r *http.Request, cfg serveConfig) bool {
+	if isUnixSocket(cfg.listen) && peerCredSupported {
+		return true
+	}
+
+	if cfg.authToken == "" {
+		return false
+	}
+
+	want := "Bearer " + cfg.authToken
+
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) == 1
+}
+
+func isUnixSocket(listen string) bool {
+	return strings.HasPrefix(listen, "unix:")
+}
+
+// newServeListener opens the listener for --serve.listen, which is either a
+// plain TCP address or a "unix:/path/to.sock" socket. Unix sockets are
+// wrapped so only peers with this process's UID are accepted, enforcing
+// --serve.auth-token-less access control at the transport layer. On
+// platforms where that check isn't implemented (see peerCredSupported), the
+// socket is left unfiltered and a warning is logged, since relying on
+// --serve.auth-token is then the caller's only access control.
+func newServeListener(listen string, logger log.Logger) (net.Listener, error) {
+	if !isUnixSocket(listen) {
+		return net.Listen("tcp", listen)
+	}
+
+	path := strings.TrimPrefix(listen, "unix:")
+	_ = os.Remove(path) // Best-effort cleanup of a socket left behind by a previous run.
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !peerCredSupported {
+		level.Warn(logger).Log(
+			"msg", "Unix-socket peer credential checks are not implemented on this platform; "+
+				"every connection to --serve.listen will be accepted and must present --serve.auth-token",
+			"listen", listen,
+		)
+		return l, nil
+	}
+
+	return &peerCredListener{l}, nil
+}
+
+// peerCredListener only hands accepted connections to the caller once
+// peerCredAllowed confirms the connecting peer's credentials.
+type peerCredListener struct {
+	net.Listener
+}
+
+func (l *peerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if peerCredAllowed(conn) {
+			return conn, nil
+		}
+
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,41 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// peerCredSupported reports whether peerCredAllowed can verify a Unix socket
+// peer's identity on this platform.
+const peerCredSupported = true
+
+// peerCredAllowed reports whether conn's Unix socket peer shares this
+// process's UID, used to gate the token-serving endpoint without a bearer
+// secret when --serve.listen is a Unix socket.
+func peerCredAllowed(conn net.Conn) bool {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return false
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return false
+	}
+	if credErr != nil {
+		return false
+	}
+
+	return int(cred.Uid) == os.Getuid()
+}
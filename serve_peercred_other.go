@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// peerCredSupported reports whether peerCredAllowed can verify a Unix socket
+// peer's identity on this platform. It can't here, so newServeListener skips
+// peerCredListener entirely on this platform rather than calling
+// peerCredAllowed to reject every connection.
+const peerCredSupported = false
+
+// peerCredAllowed always rejects, since SO_PEERCRED is a Linux-specific
+// mechanism unavailable on this platform. It is unused while
+// peerCredSupported is false, kept only so peerCredListener still builds.
+func peerCredAllowed(net.Conn) bool {
+	return false
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tlsConfig configures the optional TLS listener shared by the internal,
+// proxy, forward-auth and token-serving servers.
+type tlsConfig struct {
+	certFile       string
+	keyFile        string
+	clientCAFile   string
+	reloadInterval time.Duration
+}
+
+func (c tlsConfig) enabled() bool {
+	return c.certFile != "" && c.keyFile != ""
+}
+
+// certReloadMetrics tracks the health of the certificate hot-reload loop.
+type certReloadMetrics struct {
+	reloadsTotal      *prometheus.CounterVec
+	lastReloadSeconds prometheus.Gauge
+}
+
+func newCertReloadMetrics(r prometheus.Registerer) *certReloadMetrics {
+	m := &certReloadMetrics{
+		reloadsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "tls_certificate_reloads_total",
+				Help: "A counter of TLS certificate store reloads, by result.",
+			},
+			[]string{"result"},
+		),
+		lastReloadSeconds: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "tls_certificate_last_reload_timestamp_seconds",
+				Help: "The unix timestamp of the last successful TLS certificate store reload.",
+			},
+		),
+	}
+
+	if r != nil {
+		r.MustRegister(m.reloadsTotal, m.lastReloadSeconds)
+	}
+
+	return m
+}
+
+// certStore holds the currently loaded server certificates, keyed by the
+// DNS names each one is valid for, and serves tls.Config.GetCertificate so
+// certificates can be swapped atomically while the server is running.
+type certStore struct {
+	certFiles []string
+	keyFiles  []string
+
+	mu          sync.RWMutex
+	byName      map[string]*tls.Certificate
+	defaultCert *tls.Certificate
+	modTimes    []time.Time
+
+	lastErr error
+}
+
+func newCertStore(certFiles, keyFiles []string) (*certStore, error) {
+	if len(certFiles) != len(keyFiles) {
+		return nil, fmt.Errorf("got %d cert file(s) but %d key file(s)", len(certFiles), len(keyFiles))
+	}
+
+	s := &certStore{
+		certFiles: certFiles,
+		keyFiles:  keyFiles,
+		modTimes:  make([]time.Time, len(certFiles)),
+	}
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// GetCertificate selects a certificate by SNI server name, falling back to
+// the first configured certificate when there is no match.
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if hello.ServerName != "" {
+		if cert, ok := s.byName[strings.ToLower(hello.ServerName)]; ok {
+			return cert, nil
+		}
+	}
+
+	return s.defaultCert, nil
+}
+
+// changed reports whether any cert or key file has been modified since the
+// last successful reload.
+func (s *certStore) changed() (bool, error) {
+	for i, f := range s.certFiles {
+		for _, file := range []string{f, s.keyFiles[i]} {
+			fi, err := os.Stat(file)
+			if err != nil {
+				return false, fmt.Errorf("failed to stat %s: %w", file, err)
+			}
+			if fi.ModTime().After(s.modTimes[i]) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// reload reads every configured cert/key pair from disk and atomically
+// swaps the name->certificate lookup table.
+func (s *certStore) reload() error {
+	byName := make(map[string]*tls.Certificate)
+	modTimes := make([]time.Time, len(s.certFiles))
+	var defaultCert *tls.Certificate
+
+	for i, certFile := range s.certFiles {
+		keyFile := s.keyFiles[i]
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate pair %s/%s: %w", certFile, keyFile, err)
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse leaf certificate %s: %w", certFile, err)
+		}
+
+		if defaultCert == nil {
+			defaultCert = &cert
+		}
+
+		names := leaf.DNSNames
+		if leaf.Subject.CommonName != "" {
+			names = append(names, leaf.Subject.CommonName)
+		}
+		for _, name := range names {
+			byName[strings.ToLower(name)] = &cert
+		}
+
+		fi, err := os.Stat(certFile)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", certFile, err)
+		}
+		modTimes[i] = fi.ModTime()
+
+		ki, err := os.Stat(keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", keyFile, err)
+		}
+		if ki.ModTime().After(modTimes[i]) {
+			modTimes[i] = ki.ModTime()
+		}
+	}
+
+	s.mu.Lock()
+	s.byName = byName
+	s.defaultCert = defaultCert
+	s.modTimes = modTimes
+	s.mu.Unlock()
+
+	return nil
+}
+
+// watch polls the configured cert/key files every interval and reloads the
+// store whenever one of them changes, until ctx is cancelled. Reload
+// failures are logged and recorded, but never cause watch to return, so a
+// broken cert-manager rotation cannot crash the process.
+func (s *certStore) watch(ctx context.Context, interval time.Duration, metrics *certReloadMetrics, logger log.Logger) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			changed, err := s.changed()
+			if err != nil {
+				s.recordErr(metrics, err)
+				level.Error(logger).Log("msg", "failed to check TLS certificates for changes", "err", err)
+				continue
+			}
+			if !changed {
+				continue
+			}
+
+			if err := s.reload(); err != nil {
+				s.recordErr(metrics, err)
+				level.Error(logger).Log("msg", "failed to reload TLS certificates", "err", err)
+				continue
+			}
+
+			s.recordErr(metrics, nil)
+			metrics.reloadsTotal.WithLabelValues("success").Inc()
+			metrics.lastReloadSeconds.Set(float64(time.Now().Unix()))
+			level.Info(logger).Log("msg", "reloaded TLS certificates")
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (s *certStore) recordErr(metrics *certReloadMetrics, err error) {
+	if err != nil {
+		metrics.reloadsTotal.WithLabelValues("failure").Inc()
+	}
+
+	s.mu.Lock()
+	s.lastErr = err
+	s.mu.Unlock()
+}
+
+// readinessCheck reports the last TLS certificate reload error, if any, so
+// it can be wired into the internal server's /ready endpoint.
+func (s *certStore) readinessCheck() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.lastErr
+}
+
+// cloneTLSConfig returns a copy of tlsCfg for a single server to use, or nil
+// if TLS is disabled.
+func cloneTLSConfig(tlsCfg *tls.Config) *tls.Config {
+	if tlsCfg == nil {
+		return nil
+	}
+
+	return tlsCfg.Clone()
+}
+
+// serve starts s, serving TLS if it has been configured with a TLSConfig.
+func serve(s *http.Server) error {
+	if s.TLSConfig != nil {
+		return s.ListenAndServeTLS("", "")
+	}
+
+	return s.ListenAndServe()
+}
+
+// loadCertPool reads a PEM-encoded file of one or more CA certificates,
+// used to verify client certificates for mTLS.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return pool, nil
+}
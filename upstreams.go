@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v2"
+)
+
+// upstreamsFile is the schema of the file passed via --config.file. It
+// describes one or more backends a single token-refresher instance can
+// front, each selected by its own match rule and authenticated against its
+// own OIDC client.
+type upstreamsFile struct {
+	Upstreams []upstreamConfig `yaml:"upstreams"`
+}
+
+type upstreamConfig struct {
+	Name  string        `yaml:"name"`
+	Match upstreamMatch `yaml:"match"`
+	URL   string        `yaml:"url"`
+	OIDC  upstreamOIDC  `yaml:"oidc"`
+}
+
+type upstreamMatch struct {
+	Prefix string `yaml:"prefix"`
+	Host   string `yaml:"host"`
+}
+
+type upstreamOIDC struct {
+	IssuerURL    string `yaml:"issuerURL"`
+	ClientID     string `yaml:"clientID"`
+	ClientSecret string `yaml:"clientSecret"`
+	Audience     string `yaml:"audience"`
+
+	AuthMethod                string `yaml:"authMethod"`
+	JWTSigningKeyFile         string `yaml:"jwtSigningKeyFile"`
+	WorkloadIdentityTokenFile string `yaml:"workloadIdentityTokenFile"`
+	TLSClientCertFile         string `yaml:"tlsClientCertFile"`
+	TLSClientKeyFile          string `yaml:"tlsClientKeyFile"`
+}
+
+// toConfig adapts the YAML upstream OIDC schema to the internal oidcConfig
+// consumed by newTokenSource, defaulting AuthMethod the same way
+// --oidc.auth-method does.
+func (o upstreamOIDC) toConfig() oidcConfig {
+	authMethod := o.AuthMethod
+	if authMethod == "" {
+		authMethod = authMethodClientSecretBasic
+	}
+
+	return oidcConfig{
+		issuerURL:                 o.IssuerURL,
+		clientID:                  o.ClientID,
+		clientSecret:              o.ClientSecret,
+		audience:                  o.Audience,
+		authMethod:                authMethod,
+		jwtSigningKeyFile:         o.JWTSigningKeyFile,
+		workloadIdentityTokenFile: o.WorkloadIdentityTokenFile,
+		tlsClientCertFile:         o.TLSClientCertFile,
+		tlsClientKeyFile:          o.TLSClientKeyFile,
+	}
+}
+
+// resolveUpstreams returns the upstreams the proxy server should serve: the
+// ones declared in cfg.configFile, or, as a degenerate single-upstream case,
+// the one derived from --url/--oidc.*.
+func resolveUpstreams(cfg *config) ([]upstreamConfig, error) {
+	if cfg.configFile != "" {
+		return loadUpstreamsFile(cfg.configFile)
+	}
+
+	return []upstreamConfig{
+		{
+			Name: "default",
+			URL:  cfg.url.String(),
+			OIDC: upstreamOIDC{
+				IssuerURL:                 cfg.oidc.issuerURL,
+				ClientID:                  cfg.oidc.clientID,
+				ClientSecret:              cfg.oidc.clientSecret,
+				Audience:                  cfg.oidc.audience,
+				AuthMethod:                cfg.oidc.authMethod,
+				JWTSigningKeyFile:         cfg.oidc.jwtSigningKeyFile,
+				WorkloadIdentityTokenFile: cfg.oidc.workloadIdentityTokenFile,
+				TLSClientCertFile:         cfg.oidc.tlsClientCertFile,
+				TLSClientKeyFile:          cfg.oidc.tlsClientKeyFile,
+			},
+		},
+	}, nil
+}
+
+// loadUpstreamsFile reads and parses the YAML/JSON upstreams config file at
+// path. JSON is valid YAML, so both formats are accepted.
+func loadUpstreamsFile(path string) ([]upstreamConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var f upstreamsFile
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	if len(f.Upstreams) == 0 {
+		return nil, errors.New("no upstreams configured")
+	}
+
+	for i, u := range f.Upstreams {
+		if u.Name == "" {
+			return nil, fmt.Errorf("upstreams[%d]: name is required", i)
+		}
+		if u.Match.Prefix == "" && u.Match.Host == "" {
+			return nil, fmt.Errorf("upstreams[%d]: match.prefix or match.host is required", i)
+		}
+		if u.URL == "" {
+			return nil, fmt.Errorf("upstreams[%d]: url is required", i)
+		}
+	}
+
+	return f.Upstreams, nil
+}
+
+// newMatcher builds the request predicate for an upstream's match rule. An
+// empty rule matches every request.
+func newMatcher(m upstreamMatch) func(*http.Request) bool {
+	switch {
+	case m.Prefix != "" && m.Host != "":
+		return func(r *http.Request) bool {
+			return r.Host == m.Host && strings.HasPrefix(r.URL.Path, m.Prefix)
+		}
+	case m.Prefix != "":
+		return func(r *http.Request) bool {
+			return strings.HasPrefix(r.URL.Path, m.Prefix)
+		}
+	case m.Host != "":
+		return func(r *http.Request) bool {
+			return r.Host == m.Host
+		}
+	default:
+		return func(*http.Request) bool {
+			return true
+		}
+	}
+}
+
+// newReverseProxy builds a reverse proxy forwarding requests to target,
+// rewriting the request path the same way the single-upstream mode always
+// has.
+func newReverseProxy(target *url.URL, transport http.RoundTripper) *httputil.ReverseProxy {
+	p := &httputil.ReverseProxy{
+		Director: func(request *http.Request) {
+			request.URL.Scheme = target.Scheme
+			// Set the Host at both request and request.URL objects.
+			request.Host = target.Host
+			request.URL.Host = target.Host
+			// Derive path from the paths of configured URL and request URL.
+			request.URL.Path, request.URL.RawPath = joinURLPath(target, request.URL)
+			// Add prefix header with value "/", since from a client's perspective
+			// we are forwarding /<anything> to /<target.Path>/<anything>.
+			request.Header.Add(prefixHeader, "/")
+		},
+	}
+	p.Transport = transport
+
+	return p
+}
+
+// route pairs a matcher with the reverse proxy it should dispatch to. down
+// is set once this upstream's token refresh loop has exited fatally (e.g.
+// rotated/invalid credentials), so that one misconfigured upstream serves
+// 502s for its own routes instead of taking the whole proxy server down.
+type route struct {
+	name    string
+	matches func(*http.Request) bool
+	proxy   *httputil.ReverseProxy
+	down    *atomic.Bool
+}
+
+// multiUpstreamHandler dispatches requests to the first route whose matcher
+// accepts the request, in declaration order.
+type multiUpstreamHandler struct {
+	routes []route
+}
+
+func (h *multiUpstreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, rt := range h.routes {
+		if rt.matches(r) {
+			if rt.down.Load() {
+				http.Error(w, fmt.Sprintf("upstream %q is unavailable: token refresh failed", rt.name), http.StatusBadGateway)
+				return
+			}
+			rt.proxy.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	http.NotFound(w, r)
+}